@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 // my_gcd calculates the Greatest Common Divisor of two integers.
@@ -13,110 +18,506 @@ func my_gcd(a, b int) int {
 	return a
 }
 
+// DurationOptions controls how a fraction of a whole note is broken into
+// LilyPond durations.
+type DurationOptions struct {
+	// MaxSubdivision is the shortest note value allowed, as a power-of-two
+	// denominator (128 means 128th notes, 512 allows 512th notes). It may
+	// not exceed maxLilypondSubdivision. Zero means the default of 128.
+	MaxSubdivision int
+	// AllowBreveLonga lets fractions greater than one use \breve (2/1) and
+	// \longa (4/1) instead of tied whole notes.
+	AllowBreveLonga bool
+	// MaxDots limits the number of augmentation dots on a single note. Dots
+	// are only used below a whole note or for a single-note match; longer
+	// values are tied whole notes (or breves and longas). Zero allows no dots.
+	MaxDots int
+	// Approximate rounds power-of-two values shorter than MaxSubdivision to
+	// the nearest multiple of 1/MaxSubdivision (but never to nothing)
+	// instead of returning "Complex: n/d".
+	Approximate bool
+	// Verify re-adds the emitted durations before returning them. A mismatch
+	// is reported in-band, like "Complex: n/d": the result is a single
+	// "Verification failed: ..." entry, which callers must check for before
+	// sending output on to LilyPond.
+	Verify bool
+}
+
+// DefaultDurationOptions returns the options used by FractionToLilypond.
+func DefaultDurationOptions() DurationOptions {
+	return DurationOptions{
+		MaxSubdivision:  128,
+		AllowBreveLonga: false,
+		MaxDots:         2,
+	}
+}
+
+// maxLilypondSubdivision is the shortest duration LilyPond can print (1024th).
+const maxLilypondSubdivision = 1024
+
+// validMaxSubdivision reports whether maxSubdivision is a power of two no
+// finer than maxLilypondSubdivision.
+func validMaxSubdivision(maxSubdivision int) bool {
+	return maxSubdivision > 0 && maxSubdivision <= maxLilypondSubdivision &&
+		maxSubdivision&(maxSubdivision-1) == 0
+}
+
+// maxTiedWholeNotes bounds how long a single converted value may be. Longer
+// values return "Complex: n/d" rather than an unbounded tie chain, and the
+// bound keeps every product in convertDuration far below int overflow.
+const maxTiedWholeNotes = 64
+
+// normalizeDurationOptions fills in a zero MaxSubdivision and clamps MaxDots,
+// so equivalent options share cache entries. It reports false if
+// MaxSubdivision is not valid.
+func normalizeDurationOptions(opts DurationOptions) (DurationOptions, bool) {
+	if opts.MaxSubdivision == 0 {
+		opts.MaxSubdivision = DefaultDurationOptions().MaxSubdivision
+	}
+	if !validMaxSubdivision(opts.MaxSubdivision) {
+		return opts, false
+	}
+	if opts.MaxDots < 0 {
+		opts.MaxDots = 0
+	}
+	if limit := maxUsefulDots(opts); opts.MaxDots > limit {
+		opts.MaxDots = limit
+	}
+	return opts, true
+}
+
+// maxUsefulDots is the most dots that can fit within opts.MaxSubdivision: a
+// longa (4/1) reaches 1/MaxSubdivision after log2(MaxSubdivision)+2 dots.
+func maxUsefulDots(opts DurationOptions) int {
+	return bits.Len(uint(opts.MaxSubdivision)) + 1
+}
+
+// maxDurationCacheEntries bounds the memoized conversions so callers feeding
+// arbitrary numerators cannot grow the cache without limit.
+const maxDurationCacheEntries = 4096
+
+// durationKey identifies a conversion by its reduced fraction and options.
+type durationKey struct {
+	numerator   int
+	denominator int
+	opts        DurationOptions
+}
+
+var (
+	durationCacheMu sync.Mutex
+	durationTables  = map[DurationOptions][]durationValue{}
+	durationCache   = map[durationKey][]string{}
+)
+
+// durationValue is a single LilyPond duration and its length in whole notes.
+type durationValue struct {
+	numerator   int
+	denominator int
+	dots        int
+	lilypond    string
+}
+
+// durationTable lists every single-note duration allowed by opts, longest first.
+func durationTable(opts DurationOptions) []durationValue {
+	type base struct {
+		numerator   int
+		denominator int
+		lilypond    string
+	}
+	bases := []base{}
+	if opts.AllowBreveLonga {
+		bases = append(bases, base{4, 1, "\\longa"}, base{2, 1, "\\breve"})
+	}
+	for denom := 1; denom <= opts.MaxSubdivision; denom *= 2 {
+		bases = append(bases, base{1, denom, strconv.Itoa(denom)})
+	}
+
+	table := []durationValue{}
+	for _, b := range bases {
+		values := []durationValue{}
+		for dots := 0; dots <= opts.MaxDots; dots++ {
+			numerator := b.numerator * (1<<(dots+1) - 1)
+			denominator := b.denominator << dots
+			common := my_gcd(numerator, denominator)
+			numerator /= common
+			denominator /= common
+			if denominator > opts.MaxSubdivision {
+				break
+			}
+			values = append(values, durationValue{numerator, denominator, dots, b.lilypond + strings.Repeat(".", dots)})
+		}
+
+		// Dotted values of a base sit between it and the next longer base, so
+		// adding them most-dotted first keeps the table sorted.
+		for i := len(values) - 1; i >= 0; i-- {
+			table = append(table, values[i])
+		}
+	}
+	return table
+}
+
+// cachedDurationTable returns the duration table for opts, building it on
+// first use. opts must already have MaxDots clamped; Approximate and Verify do
+// not affect the table and are dropped from the key, so at most a few hundred
+// tables exist.
+func cachedDurationTable(opts DurationOptions) []durationValue {
+	opts.Approximate = false
+	opts.Verify = false
+	durationCacheMu.Lock()
+	defer durationCacheMu.Unlock()
+	table, ok := durationTables[opts]
+	if !ok {
+		table = durationTable(opts)
+		durationTables[opts] = table
+	}
+	return table
+}
+
 // FractionToLilypond converts a fraction to LilyPond duration strings.
 func FractionToLilypond(numerator int, denominator int) []string {
+	return FractionToLilypondWithOptions(numerator, denominator, DefaultDurationOptions())
+}
+
+// FractionToLilypondWithOptions converts a fraction to LilyPond duration
+// strings, tying together as many notes as needed within the limits of opts.
+// Values longer than maxTiedWholeNotes whole notes return "Complex: n/d".
+func FractionToLilypondWithOptions(numerator int, denominator int, opts DurationOptions) []string {
 	if denominator == 0 {
 		return []string{"Invalid denominator"}
 	}
+	opts, ok := normalizeDurationOptions(opts)
+	if !ok {
+		return []string{fmt.Sprintf("Invalid max subdivision: %d", opts.MaxSubdivision)}
+	}
 
-	lilypondMap := map[string]string{
-		"1/1":   "1",
-		"1/2":   "2",
-		"1/4":   "4",
-		"1/8":   "8",
-		"1/16":  "16",
-		"1/32":  "32",
-		"1/64":  "64",
-		"1/128": "128",
-		"3/2":   "1.",
-		"3/4":   "2.",
-		"3/8":   "4.",
-		"3/16":  "8.",
-		"3/32":  "16.",
-		"3/64":  "32.",
-		"3/128": "64.",
-		"7/4":   "1..",
-		"7/8":   "2..",
-		"7/16":  "4..",
-		"7/32":  "8..",
-		"7/64":  "16..",
-		"7/128": "32..",
-	}
-
-	fractionStr := fmt.Sprintf("%d/%d", numerator, denominator)
-	if lilypondDuration, ok := lilypondMap[fractionStr]; ok {
-		return []string{lilypondDuration}
-	}
-
-	result := []string{}
-	remainingNumerator := numerator
-	remainingDenominator := denominator
-
-	commonDenominators := []int{1, 2, 4, 8, 16, 32, 64, 128}
-
-	// Loop Detection
-	seenFractions := make(map[string]bool)
+	reducedNumerator, reducedDenominator := normalizeFraction(numerator, denominator)
+	if reducedNumerator <= 0 {
+		return []string{}
+	}
+	if opts.Approximate && reducedDenominator > opts.MaxSubdivision &&
+		reducedDenominator&(reducedDenominator-1) == 0 {
+		reducedNumerator, reducedDenominator = approximateFraction(reducedNumerator, reducedDenominator, opts.MaxSubdivision)
+	}
+	key := durationKey{reducedNumerator, reducedDenominator, opts}
 
-	for remainingNumerator > 0 {
-		currentFraction := fmt.Sprintf("%d/%d", remainingNumerator, remainingDenominator)
-		if seenFractions[currentFraction] {
-			// Loop detected! Fallback to ties
-			return tieFallback(numerator, denominator, commonDenominators)
+	durationCacheMu.Lock()
+	cached, ok := durationCache[key]
+	durationCacheMu.Unlock()
+	if ok {
+		return append([]string(nil), cached...)
+	}
+
+	result := convertDuration(key.numerator, key.denominator, opts, cachedDurationTable(opts))
+	if result == nil {
+		return []string{fmt.Sprintf("Complex: %d/%d", numerator, denominator)}
+	}
+	if opts.Verify {
+		if failure, ok := verifiedDurations(key.numerator, key.denominator, result); !ok {
+			return failure
 		}
-		seenFractions[currentFraction] = true
+	}
+
+	durationCacheMu.Lock()
+	if len(durationCache) < maxDurationCacheEntries {
+		durationCache[key] = result
+	}
+	durationCacheMu.Unlock()
+
+	return append([]string(nil), result...)
+}
+
+// convertDuration decomposes a reduced fraction into tied LilyPond durations
+// drawn from table, which must be durationTable(opts). It returns nil if the fraction cannot be written without tuplets or is
+// longer than maxTiedWholeNotes.
+func convertDuration(remainingNumerator int, remainingDenominator int, opts DurationOptions, table []durationValue) []string {
+	// Only power-of-two denominators up to the subdivision limit can be
+	// written without tuplets.
+	if remainingDenominator <= 0 || remainingDenominator&(remainingDenominator-1) != 0 ||
+		remainingDenominator > opts.MaxSubdivision {
+		return nil
+	}
+	// With the denominator at most maxLilypondSubdivision, this keeps the
+	// numerator below 2^16 and every cross-multiplication below 2^30.
+	if remainingNumerator > maxTiedWholeNotes*remainingDenominator {
+		return nil
+	}
+
+	// A value that a single note can hold is written as that note.
+	for _, value := range table {
+		if value.numerator*remainingDenominator == remainingNumerator*value.denominator {
+			return []string{value.lilypond}
+		}
+	}
+
+	tiedResult := []string{}
 
-		bestDenominator := -1
-		for i := len(commonDenominators) - 1; i >= 0; i-- {
-			denom := commonDenominators[i]
-			if remainingNumerator*denom <= remainingDenominator {
-				bestDenominator = denom
+	for remainingNumerator > 0 {
+		// Whole notes and longer are tied undotted so bars read as "1 ~ 1";
+		// dots are only used for what is left below a whole note. Otherwise
+		// take the longest duration that still fits. The shortest entry is
+		// 1/MaxSubdivision, so this always makes progress.
+		whole := remainingNumerator >= remainingDenominator
+		var best durationValue
+		for _, value := range table {
+			if whole && value.dots > 0 {
+				continue
+			}
+			if value.numerator*remainingDenominator <= remainingNumerator*value.denominator {
+				best = value
 				break
 			}
 		}
 
-		if bestDenominator == -1 {
-			return []string{fmt.Sprintf("Complex: %d/%d", numerator, denominator)}
+		// Add ties
+		if len(tiedResult) > 0 {
+			tiedResult = append(tiedResult, "~")
 		}
-
-		bestNum := remainingNumerator * bestDenominator / remainingDenominator
-		result = append(result, fmt.Sprintf("%d", remainingDenominator/bestDenominator))
-		remainingNumerator = remainingNumerator*bestDenominator - bestNum*remainingDenominator
-		remainingDenominator = remainingDenominator * bestDenominator
+		tiedResult = append(tiedResult, best.lilypond)
+		remainingNumerator = remainingNumerator*best.denominator - best.numerator*remainingDenominator
+		remainingDenominator = remainingDenominator * best.denominator
 
 		// ---  SIMPLIFY ---
-		common := my_gcd(remainingNumerator, remainingDenominator)
-		remainingNumerator /= common
-		remainingDenominator /= common
+		if remainingNumerator > 0 {
+			common := my_gcd(remainingNumerator, remainingDenominator)
+			remainingNumerator /= common
+			remainingDenominator /= common
+		}
 	}
 
-	// Add ties (if the main logic succeeded)
-	tiedResult := []string{}
-	for i, note := range result {
-		tiedResult = append(tiedResult, note)
-		if i < len(result)-1 {
-			tiedResult = append(tiedResult, "~")
+	return tiedResult
+}
+
+// approximateFraction rounds numerator/denominator, where denominator is a
+// power of two above maxSubdivision, to the nearest multiple of
+// 1/maxSubdivision, and never below it. The result is reduced.
+func approximateFraction(numerator int, denominator int, maxSubdivision int) (int, int) {
+	step := denominator / maxSubdivision
+	rounded := numerator / step
+	if numerator%step >= step-numerator%step {
+		rounded++
+	}
+	if rounded == 0 {
+		rounded = 1
+	}
+	return normalizeFraction(rounded, maxSubdivision)
+}
+
+// verifiedDurations is the Verify step of FractionToLilypondWithOptions. It
+// returns durations and true if they add up to numerator/denominator, and a
+// single "Verification failed: ..." entry and false if not.
+func verifiedDurations(numerator int, denominator int, durations []string) ([]string, bool) {
+	if err := VerifyLilypondDurations(numerator, denominator, durations); err != nil {
+		return []string{fmt.Sprintf("Verification failed: %v", err)}, false
+	}
+	return durations, true
+}
+
+// ParseLilypondDuration returns the length in whole notes of a single
+// LilyPond duration such as "8", "4..", or "\breve.". Durations shorter
+// than maxLilypondSubdivision, or with more dots than could ever fit above
+// it, are rejected so the result cannot overflow.
+func ParseLilypondDuration(duration string) (numerator int, denominator int, ok bool) {
+	base := strings.TrimRight(duration, ".")
+	dots := len(duration) - len(base)
+	if dots > maxUsefulDots(DurationOptions{MaxSubdivision: maxLilypondSubdivision}) {
+		return 0, 0, false
+	}
+
+	switch base {
+	case "\\longa":
+		numerator, denominator = 4, 1
+	case "\\breve":
+		numerator, denominator = 2, 1
+	default:
+		// LilyPond writes plain digits, so reject signs and leading zeros
+		// that strconv.Atoi would accept ("+4", "04").
+		if base == "" || base[0] == '0' || strings.Trim(base, "0123456789") != "" {
+			return 0, 0, false
 		}
+		denom, err := strconv.Atoi(base)
+		if err != nil || denom > maxLilypondSubdivision || denom&(denom-1) != 0 {
+			return 0, 0, false
+		}
+		numerator, denominator = 1, denom
 	}
 
-	return tiedResult
+	// Each dot adds half of the previous value: n dots give (2^(n+1)-1)/2^n.
+	numerator *= 1<<(dots+1) - 1
+	denominator <<= dots
+	common := my_gcd(numerator, denominator)
+	return numerator / common, denominator / common, true
 }
 
-// tieFallback decomposes the fraction into the smallest possible notes and ties them.
-func tieFallback(numerator int, denominator int, commonDenominators []int) []string {
-	result := []string{}
-	for numerator > 0 {
-		result = append(result, fmt.Sprintf("%d", denominator))
-		numerator--
+// VerifyLilypondDurations checks that durations is a well-formed tie chain
+// (duration, "~", duration, ...) whose total length equals
+// numerator/denominator.
+func VerifyLilypondDurations(numerator int, denominator int, durations []string) error {
+	if len(durations) == 0 {
+		return errors.New("no durations")
 	}
 
-	tiedResult := []string{}
-	for i, note := range result {
-		tiedResult = append(tiedResult, note)
-		if i < len(result)-1 {
-			tiedResult = append(tiedResult, "~")
+	sumNumerator, sumDenominator := 0, 1
+	for i, duration := range durations {
+		if i%2 == 1 {
+			if duration != "~" {
+				return fmt.Errorf("expected tie at position %d, got %q", i, duration)
+			}
+			continue
+		}
+		n, d, ok := ParseLilypondDuration(duration)
+		if !ok {
+			return fmt.Errorf("invalid duration %q at position %d", duration, i)
 		}
+		sumNumerator = sumNumerator*d + n*sumDenominator
+		sumDenominator *= d
+		common := my_gcd(sumNumerator, sumDenominator)
+		sumNumerator /= common
+		sumDenominator /= common
 	}
-	return tiedResult
+	if len(durations)%2 == 0 {
+		return errors.New("tie chain ends with a tie")
+	}
+
+	if sumNumerator*denominator != numerator*sumDenominator {
+		return fmt.Errorf("durations sum to %d/%d, want %d/%d", sumNumerator, sumDenominator, numerator, denominator)
+	}
+	return nil
+}
+
+// DurationRepresentation describes how a fraction is written in LilyPond.
+type DurationRepresentation int
+
+const (
+	// DurationExact is a single undotted note.
+	DurationExact DurationRepresentation = iota
+	// DurationDotted is a single dotted note.
+	DurationDotted
+	// DurationTied needs several notes joined by ties.
+	DurationTied
+	// DurationApproximated is a power-of-two value shorter than
+	// MaxSubdivision allows, written at its rounded length because
+	// DurationOptions.Approximate is set.
+	DurationApproximated
+	// DurationTuplet has a denominator that is not a power of two and needs
+	// a tuplet, which FractionToLilypond does not generate.
+	DurationTuplet
+	// DurationUnsupported is empty, negative, longer than maxTiedWholeNotes,
+	// shorter than MaxSubdivision without Approximate, or has invalid options.
+	DurationUnsupported
+)
+
+func (r DurationRepresentation) String() string {
+	switch r {
+	case DurationExact:
+		return "exact"
+	case DurationDotted:
+		return "dotted"
+	case DurationTied:
+		return "tied"
+	case DurationApproximated:
+		return "approximated"
+	case DurationTuplet:
+		return "tuplet"
+	default:
+		return "unsupported"
+	}
+}
+
+// normalizeFraction moves the sign onto the numerator and reduces the
+// fraction. Every zero denominator becomes 1/0, so invalid inputs compare
+// equal.
+func normalizeFraction(numerator int, denominator int) (int, int) {
+	if denominator == 0 {
+		return 1, 0
+	}
+	if denominator < 0 {
+		numerator, denominator = -numerator, -denominator
+	}
+	common := my_gcd(numerator, denominator)
+	if common < 0 {
+		common = -common
+	}
+	return numerator / common, denominator / common
+}
+
+// ClassifyDuration reports how FractionToLilypondWithOptions represents
+// numerator/denominator under opts.
+func ClassifyDuration(numerator int, denominator int, opts DurationOptions) DurationRepresentation {
+	representation, _ := describeDuration(numerator, denominator, opts)
+	return representation
+}
+
+// describeDuration converts a fraction once and classifies the result.
+func describeDuration(numerator int, denominator int, opts DurationOptions) (DurationRepresentation, []string) {
+	result := FractionToLilypondWithOptions(numerator, denominator, opts)
+
+	numerator, denominator = normalizeFraction(numerator, denominator)
+	opts, valid := normalizeDurationOptions(opts)
+	switch {
+	case numerator <= 0 || denominator == 0 || !valid:
+		return DurationUnsupported, result
+	case denominator&(denominator-1) != 0:
+		return DurationTuplet, result
+	}
+	if _, _, ok := ParseLilypondDuration(result[0]); !ok {
+		return DurationUnsupported, result
+	}
+
+	switch {
+	case denominator > opts.MaxSubdivision:
+		return DurationApproximated, result
+	case len(result) > 1:
+		return DurationTied, result
+	case strings.HasSuffix(result[0], "."):
+		return DurationDotted, result
+	default:
+		return DurationExact, result
+	}
+}
+
+// DurationCoverageEntry is one distinct fraction in a coverage report.
+type DurationCoverageEntry struct {
+	Numerator      int
+	Denominator    int
+	Count          int
+	Representation DurationRepresentation
+	Lilypond       []string
+}
+
+// DurationCoverage reduces and counts fractions, then reports how each
+// distinct value is written in LilyPond, shortest first. Use it to find
+// durations that need ties, approximation, or tuplets before publishing.
+func DurationCoverage(fractions [][2]int, opts DurationOptions) []DurationCoverageEntry {
+	index := map[[2]int]int{}
+	entries := []DurationCoverageEntry{}
+
+	for _, frac := range fractions {
+		numerator, denominator := normalizeFraction(frac[0], frac[1])
+		key := [2]int{numerator, denominator}
+		if i, ok := index[key]; ok {
+			entries[i].Count++
+			continue
+		}
+		index[key] = len(entries)
+		representation, lilypond := describeDuration(numerator, denominator, opts)
+		entries = append(entries, DurationCoverageEntry{
+			Numerator:      numerator,
+			Denominator:    denominator,
+			Count:          1,
+			Representation: representation,
+			Lilypond:       lilypond,
+		})
+	}
+
+	// Denominators are non-negative after normalizing; 1/0 sorts last.
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Denominator == 0 || b.Denominator == 0 {
+			return a.Denominator != 0 && b.Denominator == 0
+		}
+		return a.Numerator*b.Denominator < b.Numerator*a.Denominator
+	})
+	return entries
 }
 
 func main_test() {
@@ -132,6 +533,6 @@ func main_test() {
 
 	for _, frac := range fractions {
 		result := FractionToLilypond(frac[0], frac[1])
-		fmt.Printf("%d/%d  =>  %s\n", frac[0], strings.Join(result, " "))
+		fmt.Printf("%d/%d  =>  %s\n", frac[0], frac[1], strings.Join(result, " "))
 	}
 }
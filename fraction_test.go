@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFractionToLilypond(t *testing.T) {
+	breveLonga := DefaultDurationOptions()
+	breveLonga.AllowBreveLonga = true
+	approximate := DefaultDurationOptions()
+	approximate.Approximate = true
+	verifyApproximate := approximate
+	verifyApproximate.Verify = true
+
+	tests := []struct {
+		numerator   int
+		denominator int
+		opts        DurationOptions
+		want        string
+	}{
+		// Single notes from the original lookup map.
+		{1, 4, DefaultDurationOptions(), "4"},
+		{3, 8, DefaultDurationOptions(), "4."},
+		{3, 2, DefaultDurationOptions(), "1."},
+		{7, 4, DefaultDurationOptions(), "1.."},
+		{7, 64, DefaultDurationOptions(), "16.."},
+
+		// Unreduced input used to miss the lookup map: 2/8 was "2".
+		{2, 8, DefaultDurationOptions(), "4"},
+		{6, 8, DefaultDurationOptions(), "2."},
+
+		// Used to loop and fall back to a chain of 1/denominator notes.
+		{5, 32, DefaultDurationOptions(), "8 ~ 32"},
+		{11, 16, DefaultDurationOptions(), "2 ~ 8."},
+		{5, 64, DefaultDurationOptions(), "16 ~ 64"},
+
+		// Longer than a whole note: tied whole notes, dots only below one.
+		{2, 1, DefaultDurationOptions(), "1 ~ 1"},
+		{4, 1, DefaultDurationOptions(), "1 ~ 1 ~ 1 ~ 1"},
+		{5, 2, DefaultDurationOptions(), "1 ~ 1 ~ 2"},
+		{11, 4, DefaultDurationOptions(), "1 ~ 1 ~ 2."},
+		{2, 1, breveLonga, "\\breve"},
+		{3, 1, breveLonga, "\\breve."},
+		{5, 2, breveLonga, "\\breve ~ 2"},
+		{8, 1, breveLonga, "\\longa ~ \\longa"},
+
+		// Tuplet values used to come out as invalid tie chains ("3 ~ 3").
+		{7, 12, DefaultDurationOptions(), "Complex: 7/12"},
+		{2, 3, DefaultDurationOptions(), "Complex: 2/3"},
+
+		// Shorter than MaxSubdivision used to be tied "256" notes.
+		{1, 256, DefaultDurationOptions(), "Complex: 1/256"},
+		{1, 256, DurationOptions{MaxSubdivision: 256, MaxDots: 2}, "256"},
+
+		// Approximate rounds to the nearest 1/MaxSubdivision, never to nothing.
+		{1, 256, approximate, "128"},
+		{3, 256, approximate, "64"},
+		{129, 256, approximate, "2 ~ 128"},
+		{1, 1024, approximate, "128"},
+		{1, 2048, approximate, "128"},
+		{1, 256, verifyApproximate, "128"},
+		{1, 3, approximate, "Complex: 1/3"},
+
+		// The sign belongs to the fraction, not to either part.
+		{-3, -8, DefaultDurationOptions(), "4."},
+		{3, -8, DefaultDurationOptions(), ""},
+		{-1, 4, DefaultDurationOptions(), ""},
+		{-7, -12, DefaultDurationOptions(), "Complex: -7/-12"},
+		{7, -12, DefaultDurationOptions(), ""},
+
+		// Long values are capped at maxTiedWholeNotes instead of growing an
+		// unbounded tie chain.
+		{64, 1, DefaultDurationOptions(), strings.Repeat("1 ~ ", 63) + "1"},
+		{129, 2, DefaultDurationOptions(), "Complex: 129/2"},
+		{1 << 20, 1, DefaultDurationOptions(), "Complex: 1048576/1"},
+		{math.MaxInt / 2, 128, DefaultDurationOptions(), fmt.Sprintf("Complex: %d/128", math.MaxInt/2)},
+		{math.MaxInt, 1, breveLonga, fmt.Sprintf("Complex: %d/1", math.MaxInt)},
+
+		// The zero value uses the default subdivision, with no dots.
+		{1, 4, DurationOptions{}, "4"},
+		{3, 8, DurationOptions{}, "4 ~ 8"},
+		{1, 128, DurationOptions{}, "128"},
+
+		{0, 4, DefaultDurationOptions(), ""},
+		{1, 0, DefaultDurationOptions(), "Invalid denominator"},
+		{1, 4, DurationOptions{MaxSubdivision: 96}, "Invalid max subdivision: 96"},
+		{1, 4, DurationOptions{MaxSubdivision: 2048}, "Invalid max subdivision: 2048"},
+		{1, 4, DurationOptions{MaxSubdivision: 1 << 62}, "Invalid max subdivision: 4611686018427387904"},
+		{7, 8, DurationOptions{MaxSubdivision: 128, MaxDots: 1 << 31}, "2.."},
+		{7, 8, DurationOptions{MaxSubdivision: 128, MaxDots: 0}, "2 ~ 4 ~ 8"},
+	}
+
+	for _, tt := range tests {
+		got := strings.Join(FractionToLilypondWithOptions(tt.numerator, tt.denominator, tt.opts), " ")
+		if got != tt.want {
+			t.Errorf("FractionToLilypondWithOptions(%d, %d, %+v) = %q, want %q",
+				tt.numerator, tt.denominator, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestDurationTableCacheIgnoresVerify(t *testing.T) {
+	opts := DurationOptions{MaxSubdivision: 32, MaxDots: 1 << 20, Approximate: true, Verify: true}
+	FractionToLilypondWithOptions(3, 8, opts)
+
+	durationCacheMu.Lock()
+	defer durationCacheMu.Unlock()
+	for key := range durationTables {
+		if key.Approximate || key.Verify {
+			t.Errorf("durationTables keyed with Approximate or Verify: %+v", key)
+		}
+		if key.MaxDots > maxUsefulDots(key) {
+			t.Errorf("durationTables keyed with unclamped MaxDots: %+v", key)
+		}
+	}
+}
+
+// TestDurationSums checks that every representable fraction up to eight
+// whole notes converts to a tie chain adding back up to exactly the input.
+func TestDurationSums(t *testing.T) {
+	optionSets := []DurationOptions{
+		DefaultDurationOptions(),
+		{MaxSubdivision: 512, AllowBreveLonga: true, MaxDots: 3},
+		{MaxSubdivision: 16, MaxDots: 0},
+		{MaxSubdivision: maxLilypondSubdivision, AllowBreveLonga: true, MaxDots: 1 << 20},
+	}
+	for _, opts := range optionSets {
+		for denominator := 1; denominator <= opts.MaxSubdivision; denominator *= 2 {
+			for numerator := 1; numerator <= 8*denominator; numerator++ {
+				result := FractionToLilypondWithOptions(numerator, denominator, opts)
+				if err := VerifyLilypondDurations(numerator, denominator, result); err != nil {
+					t.Errorf("%d/%d %+v: %v", numerator, denominator, opts, err)
+				}
+			}
+		}
+	}
+}
+
+func TestParseLilypondDuration(t *testing.T) {
+	tests := []struct {
+		duration    string
+		numerator   int
+		denominator int
+		ok          bool
+	}{
+		{"4", 1, 4, true},
+		{"8.", 3, 16, true},
+		{"2..", 7, 8, true},
+		{"\\breve", 2, 1, true},
+		{"\\longa.", 6, 1, true},
+		{"1024", 1, 1024, true},
+		{"\\longa" + strings.Repeat(".", 12), 8191, 1024, true},
+		{"\\longa" + strings.Repeat(".", 13), 0, 0, false},
+		{"4" + strings.Repeat(".", 63), 0, 0, false},
+		{"2048", 0, 0, false},
+		{"+4", 0, 0, false},
+		{"04", 0, 0, false},
+		{"-4", 0, 0, false},
+		{"0", 0, 0, false},
+		{" 4", 0, 0, false},
+		{"99999999999999999999", 0, 0, false},
+		{"3", 0, 0, false},
+		{"~", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		numerator, denominator, ok := ParseLilypondDuration(tt.duration)
+		if numerator != tt.numerator || denominator != tt.denominator || ok != tt.ok {
+			t.Errorf("ParseLilypondDuration(%q) = %d, %d, %v, want %d, %d, %v", tt.duration,
+				numerator, denominator, ok, tt.numerator, tt.denominator, tt.ok)
+		}
+	}
+}
+
+func TestVerifyLilypondDurations(t *testing.T) {
+	tests := []struct {
+		durations []string
+		wantErr   bool
+	}{
+		{[]string{"2", "~", "4"}, false},
+		{[]string{"2."}, false},
+		{[]string{"2", "~", "8"}, true},
+		{[]string{"2", "4", "4"}, true},
+		{[]string{"2.", "~"}, true},
+		{[]string{"4" + strings.Repeat(".", 63)}, true},
+		{[]string{"+2", "~", "4"}, true},
+		{[]string{"02."}, true},
+		{nil, true},
+	}
+	for _, tt := range tests {
+		err := VerifyLilypondDurations(3, 4, tt.durations)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("VerifyLilypondDurations(3, 4, %q) = %v, want error %v", tt.durations, err, tt.wantErr)
+		}
+	}
+
+	opts := DefaultDurationOptions()
+	opts.Verify = true
+	if got := strings.Join(FractionToLilypondWithOptions(11, 16, opts), " "); got != "2 ~ 8." {
+		t.Errorf("verified 11/16 = %q, want %q", got, "2 ~ 8.")
+	}
+
+	// The converter never emits a mismatch, so feed the Verify step
+	// corrupted output directly.
+	corrupted := []struct {
+		durations []string
+		want      string
+	}{
+		{[]string{"2", "~", "8"}, "Verification failed: durations sum to 5/8, want 11/16"},
+		{[]string{"2", "8."}, "Verification failed: expected tie at position 1, got \"8.\""},
+		{[]string{"2", "~", "3"}, "Verification failed: invalid duration \"3\" at position 2"},
+	}
+	for _, tt := range corrupted {
+		got, ok := verifiedDurations(11, 16, tt.durations)
+		if ok || strings.Join(got, " ") != tt.want {
+			t.Errorf("verifiedDurations(11, 16, %q) = %q, %v, want %q, false", tt.durations, got, ok, tt.want)
+		}
+	}
+	if got, ok := verifiedDurations(11, 16, []string{"2", "~", "8."}); !ok || strings.Join(got, " ") != "2 ~ 8." {
+		t.Errorf("verifiedDurations passed output = %q, %v, want it unchanged", got, ok)
+	}
+}
+
+func TestClassifyDuration(t *testing.T) {
+	approximate := DefaultDurationOptions()
+	approximate.Approximate = true
+
+	tests := []struct {
+		numerator   int
+		denominator int
+		opts        DurationOptions
+		want        DurationRepresentation
+		lilypond    string
+	}{
+		{1, 4, DefaultDurationOptions(), DurationExact, "4"},
+		{2, 8, DefaultDurationOptions(), DurationExact, "4"},
+		{-1, -4, DefaultDurationOptions(), DurationExact, "4"},
+		{3, 8, DefaultDurationOptions(), DurationDotted, "4."},
+		{7, 4, DefaultDurationOptions(), DurationDotted, "1.."},
+		{5, 16, DefaultDurationOptions(), DurationTied, "4 ~ 16"},
+		{2, 1, DefaultDurationOptions(), DurationTied, "1 ~ 1"},
+		{1, 256, approximate, DurationApproximated, "128"},
+		{3, 256, approximate, DurationApproximated, "64"},
+		{1, 1024, approximate, DurationApproximated, "128"},
+		{1, 3, DefaultDurationOptions(), DurationTuplet, "Complex: 1/3"},
+		{1, 256, DefaultDurationOptions(), DurationUnsupported, "Complex: 1/256"},
+		{65, 1, DefaultDurationOptions(), DurationUnsupported, "Complex: 65/1"},
+		{-1, 3, DefaultDurationOptions(), DurationUnsupported, ""},
+		{1, -4, DefaultDurationOptions(), DurationUnsupported, ""},
+		{0, 4, DefaultDurationOptions(), DurationUnsupported, ""},
+		{1, 0, DefaultDurationOptions(), DurationUnsupported, "Invalid denominator"},
+		{1, 4, DurationOptions{MaxSubdivision: 100}, DurationUnsupported, "Invalid max subdivision: 100"},
+	}
+	for _, tt := range tests {
+		if got := ClassifyDuration(tt.numerator, tt.denominator, tt.opts); got != tt.want {
+			t.Errorf("ClassifyDuration(%d, %d, %+v) = %v, want %v", tt.numerator, tt.denominator, tt.opts, got, tt.want)
+		}
+
+		// The report must show exactly what the converter emits.
+		got, lilypond := describeDuration(tt.numerator, tt.denominator, tt.opts)
+		converted := FractionToLilypondWithOptions(tt.numerator, tt.denominator, tt.opts)
+		if got != tt.want || strings.Join(lilypond, " ") != tt.lilypond || strings.Join(converted, " ") != tt.lilypond {
+			t.Errorf("describeDuration(%d, %d, %+v) = %v, %q (converter %q), want %v, %q", tt.numerator,
+				tt.denominator, tt.opts, got, lilypond, converted, tt.want, tt.lilypond)
+		}
+	}
+}
+
+func TestDurationCoverage(t *testing.T) {
+	fractions := [][2]int{{3, 8}, {1, -4}, {2, 8}, {-1, 4}, {1, 4}, {1, 0}, {5, 2}, {-3, -16}, {2, 0}, {-3, 0}, {0, 0}}
+	got := []string{}
+	for _, entry := range DurationCoverage(fractions, DefaultDurationOptions()) {
+		got = append(got, fmt.Sprintf("%d/%d x%d %v", entry.Numerator, entry.Denominator, entry.Count, entry.Representation))
+	}
+	want := []string{
+		"-1/4 x2 unsupported",
+		"3/16 x1 dotted",
+		"1/4 x2 exact",
+		"3/8 x1 dotted",
+		"5/2 x1 tied",
+		"1/0 x4 unsupported",
+	}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("DurationCoverage = %q, want %q", got, want)
+	}
+}
+
+var benchmarkFractions = [][2]int{{1, 4}, {3, 8}, {5, 32}, {11, 16}, {7, 64}, {5, 2}, {15, 16}, {7, 12}}
+
+// resetDurationCaches empties both caches so a benchmark measures the cold path.
+func resetDurationCaches() {
+	durationCacheMu.Lock()
+	durationTables = map[DurationOptions][]durationValue{}
+	durationCache = map[durationKey][]string{}
+	durationCacheMu.Unlock()
+}
+
+func BenchmarkFractionToLilypond(b *testing.B) {
+	// cold empties both caches before every call, outside the timer, so it
+	// measures a table build plus a conversion.
+	b.Run("cold", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			resetDurationCaches()
+			b.StartTimer()
+			f := benchmarkFractions[i%len(benchmarkFractions)]
+			FractionToLilypond(f[0], f[1])
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		resetDurationCaches()
+		for _, f := range benchmarkFractions {
+			FractionToLilypond(f[0], f[1])
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f := benchmarkFractions[i%len(benchmarkFractions)]
+			FractionToLilypond(f[0], f[1])
+		}
+	})
+}
+
+// BenchmarkConvertDuration compares building the table on every call, which
+// is what the converter did before the caches, with reusing one table.
+func BenchmarkConvertDuration(b *testing.B) {
+	opts := DefaultDurationOptions()
+	reduced := make([][2]int, len(benchmarkFractions))
+	for i, f := range benchmarkFractions {
+		common := my_gcd(f[0], f[1])
+		reduced[i] = [2]int{f[0] / common, f[1] / common}
+	}
+
+	b.Run("table-per-call", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f := reduced[i%len(reduced)]
+			convertDuration(f[0], f[1], opts, durationTable(opts))
+		}
+	})
+	b.Run("shared-table", func(b *testing.B) {
+		table := durationTable(opts)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f := reduced[i%len(reduced)]
+			convertDuration(f[0], f[1], opts, table)
+		}
+	})
+}